@@ -0,0 +1,150 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injection
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/galley/pkg/config/analysis"
+	"istio.io/istio/galley/pkg/config/analysis/msg"
+	"istio.io/istio/pkg/config/resource"
+	"istio.io/istio/pkg/config/schema/collection"
+	"istio.io/istio/pkg/config/schema/collections"
+)
+
+const (
+	deploymentKind  = "Deployment"
+	statefulSetKind = "StatefulSet"
+	daemonSetKind   = "DaemonSet"
+	replicaSetKind  = "ReplicaSet"
+)
+
+// workloadRef identifies the workload that owns a pod.
+type workloadRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// restartPlan aggregates version-mismatched pods by the workload that owns
+// them, so that a single actionable restart message is reported per
+// workload instead of once per pod.
+type restartPlan struct {
+	workloadResources map[workloadRef]*resource.Instance
+	replicaSetOwner   map[workloadRef]workloadRef
+	reported          map[workloadRef]bool
+}
+
+// newRestartPlan indexes the Deployments, StatefulSets, DaemonSets and
+// ReplicaSets in c so that mismatched pods can later be resolved to the
+// workload that should be restarted.
+func newRestartPlan(c analysis.Context) *restartPlan {
+	p := &restartPlan{
+		workloadResources: make(map[workloadRef]*resource.Instance),
+		replicaSetOwner:   make(map[workloadRef]workloadRef),
+		reported:          make(map[workloadRef]bool),
+	}
+
+	c.ForEach(collections.K8SAppsV1Deployments.Name(), func(r *resource.Instance) bool {
+		d := r.Message.(*appsv1.Deployment)
+		p.workloadResources[workloadRef{Kind: deploymentKind, Namespace: d.GetNamespace(), Name: d.GetName()}] = r
+		return true
+	})
+	c.ForEach(collections.K8SAppsV1Statefulsets.Name(), func(r *resource.Instance) bool {
+		s := r.Message.(*appsv1.StatefulSet)
+		p.workloadResources[workloadRef{Kind: statefulSetKind, Namespace: s.GetNamespace(), Name: s.GetName()}] = r
+		return true
+	})
+	c.ForEach(collections.K8SAppsV1Daemonsets.Name(), func(r *resource.Instance) bool {
+		d := r.Message.(*appsv1.DaemonSet)
+		p.workloadResources[workloadRef{Kind: daemonSetKind, Namespace: d.GetNamespace(), Name: d.GetName()}] = r
+		return true
+	})
+	c.ForEach(collections.K8SAppsV1Replicasets.Name(), func(r *resource.Instance) bool {
+		rs := r.Message.(*appsv1.ReplicaSet)
+		for _, own := range rs.OwnerReferences {
+			if own.Kind != deploymentKind {
+				continue
+			}
+			rsRef := workloadRef{Kind: replicaSetKind, Namespace: rs.GetNamespace(), Name: rs.GetName()}
+			p.replicaSetOwner[rsRef] = workloadRef{Kind: deploymentKind, Namespace: rs.GetNamespace(), Name: own.Name}
+		}
+		return true
+	})
+
+	return p
+}
+
+// resolve walks pod's owner references, through an owning ReplicaSet if
+// necessary, to find the Deployment/StatefulSet/DaemonSet it belongs to.
+func (p *restartPlan) resolve(pod *v1.Pod) (workloadRef, bool) {
+	for _, own := range pod.OwnerReferences {
+		switch own.Kind {
+		case replicaSetKind:
+			rsRef := workloadRef{Kind: replicaSetKind, Namespace: pod.GetNamespace(), Name: own.Name}
+			if dep, ok := p.replicaSetOwner[rsRef]; ok {
+				return dep, true
+			}
+		case statefulSetKind, daemonSetKind:
+			return workloadRef{Kind: own.Kind, Namespace: pod.GetNamespace(), Name: own.Name}, true
+		}
+	}
+	return workloadRef{}, false
+}
+
+// recordMismatch reports that podResource's proxy is stale, either as a
+// single, deduplicated restart message for the owning workload, or, when no
+// such workload can be resolved, as a per-pod message the way VersionAnalyzer
+// used to report exclusively.
+func (p *restartPlan) recordMismatch(c analysis.Context, podResource *resource.Instance, pod *v1.Pod, podProxyVersion, injectorVersion string) {
+	wl, ok := p.resolve(pod)
+	if !ok {
+		c.Report(collections.K8SCoreV1Pods.Name(), msg.NewIstioProxyVersionMismatch(podResource, podProxyVersion, injectorVersion))
+		return
+	}
+
+	res, ok := p.workloadResources[wl]
+	if !ok {
+		c.Report(collections.K8SCoreV1Pods.Name(), msg.NewIstioProxyVersionMismatch(podResource, podProxyVersion, injectorVersion))
+		return
+	}
+
+	if p.reported[wl] {
+		return
+	}
+	p.reported[wl] = true
+
+	cmd := fmt.Sprintf("kubectl rollout restart %s/%s -n %s", strings.ToLower(wl.Kind), wl.Name, wl.Namespace)
+	c.Report(workloadCollectionName(wl.Kind), msg.NewIstioProxyRequiresRestart(res, cmd))
+}
+
+// workloadCollectionName returns the collection a workloadRef of the given
+// kind was read from, so reports can be attributed to the right collection.
+func workloadCollectionName(kind string) collection.Name {
+	switch kind {
+	case deploymentKind:
+		return collections.K8SAppsV1Deployments.Name()
+	case statefulSetKind:
+		return collections.K8SAppsV1Statefulsets.Name()
+	case daemonSetKind:
+		return collections.K8SAppsV1Daemonsets.Name()
+	default:
+		return collections.K8SCoreV1Pods.Name()
+	}
+}
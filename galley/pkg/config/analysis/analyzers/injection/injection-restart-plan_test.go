@@ -0,0 +1,87 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injection
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func podWithOwner(ns string, owner metav1.OwnerReference) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       ns,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+	}
+}
+
+func TestRestartPlanResolve(t *testing.T) {
+	plan := &restartPlan{
+		replicaSetOwner: map[workloadRef]workloadRef{
+			{Kind: replicaSetKind, Namespace: "ns", Name: "web-abc123"}: {Kind: deploymentKind, Namespace: "ns", Name: "web"},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		pod     *v1.Pod
+		wantRef workloadRef
+		wantOk  bool
+	}{
+		{
+			name:    "owned by replicaset backed by deployment",
+			pod:     podWithOwner("ns", metav1.OwnerReference{Kind: replicaSetKind, Name: "web-abc123"}),
+			wantRef: workloadRef{Kind: deploymentKind, Namespace: "ns", Name: "web"},
+			wantOk:  true,
+		},
+		{
+			name:    "owned directly by statefulset",
+			pod:     podWithOwner("ns", metav1.OwnerReference{Kind: statefulSetKind, Name: "db"}),
+			wantRef: workloadRef{Kind: statefulSetKind, Namespace: "ns", Name: "db"},
+			wantOk:  true,
+		},
+		{
+			name:    "owned directly by daemonset",
+			pod:     podWithOwner("ns", metav1.OwnerReference{Kind: daemonSetKind, Name: "agent"}),
+			wantRef: workloadRef{Kind: daemonSetKind, Namespace: "ns", Name: "agent"},
+			wantOk:  true,
+		},
+		{
+			name:   "replicaset with no known deployment owner",
+			pod:    podWithOwner("ns", metav1.OwnerReference{Kind: replicaSetKind, Name: "orphan-xyz"}),
+			wantOk: false,
+		},
+		{
+			name:   "no owner references",
+			pod:    &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns"}},
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, ok := plan.resolve(tt.pod)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.wantRef, ref)
+			}
+		})
+	}
+}
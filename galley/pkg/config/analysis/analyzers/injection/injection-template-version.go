@@ -0,0 +1,201 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injection
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"istio.io/istio/galley/pkg/config/analysis"
+	"istio.io/istio/galley/pkg/config/analysis/msg"
+	"istio.io/istio/pkg/config/resource"
+	"istio.io/istio/pkg/config/schema/collection"
+	"istio.io/istio/pkg/config/schema/collections"
+)
+
+// TemplateVersionAnalyzer checks that the injection template embedded in the
+// sidecar injector ConfigMap(s) agrees with what's actually running, so that
+// a broken or partially applied upgrade is caught at its source rather than
+// only once it's visible on individual pods.
+type TemplateVersionAnalyzer struct{}
+
+var _ analysis.Analyzer = &TemplateVersionAnalyzer{}
+
+// sidecarInjectorConfigMapName is the ConfigMap Istio installs the injection
+// template and its values into. Revisioned installs suffix it with
+// "-<revision>".
+const sidecarInjectorConfigMapName = "istio-sidecar-injector"
+
+// valuesConfigMapKey is the ConfigMap data key holding the injection
+// template's values.yaml, the source of the resolved proxy image.
+const valuesConfigMapKey = "values"
+
+// injectionValues is the subset of the injection template's values.yaml that
+// determines the proxy image a newly injected pod will run.
+type injectionValues struct {
+	Global struct {
+		Hub   string `json:"hub"`
+		Tag   string `json:"tag"`
+		Proxy struct {
+			Image string `json:"image"`
+		} `json:"proxy"`
+	} `json:"global"`
+}
+
+// Metadata implements Analyzer.
+func (a *TemplateVersionAnalyzer) Metadata() analysis.Metadata {
+	return analysis.Metadata{
+		Name:        "injection.TemplateVersionAnalyzer",
+		Description: "Checks the injection template ConfigMap against the running injector and injected pods",
+		Inputs: collection.Names{
+			collections.K8SCoreV1ConfigMaps.Name(),
+			collections.K8SCoreV1Pods.Name(),
+		},
+	}
+}
+
+// Analyze implements Analyzer.
+func (a *TemplateVersionAnalyzer) Analyze(c analysis.Context) {
+	injectorVersions, _ := collectImageInfo(c)
+	proxyVersions := collectProxyVersions(c)
+
+	c.ForEach(collections.K8SCoreV1ConfigMaps.Name(), func(r *resource.Instance) bool {
+		cm := r.Message.(*v1.ConfigMap)
+
+		rev, ok := sidecarInjectorRevision(cm.GetName())
+		if !ok {
+			return true
+		}
+
+		templateTag, ok := resolveTemplateTag(cm.Data[valuesConfigMapKey])
+		if !ok {
+			return true
+		}
+
+		// Only flag drift once the template matches none of the injector's
+		// tags; during a rolling injector upgrade, replicas are briefly on
+		// two tags at once and one of them is expected to still differ.
+		if injector := injectorVersions[rev]; injector != nil {
+			matched, mismatch := false, ""
+			for iv := range injector.Tags {
+				if templateTag == iv {
+					matched = true
+					break
+				}
+				mismatch = iv
+			}
+			if !matched && mismatch != "" {
+				c.Report(collections.K8SCoreV1ConfigMaps.Name(), msg.NewIstioInjectionTemplateDrift(r, templateTag, mismatch))
+			}
+		}
+
+		// Only fall back to comparing proxies directly against the template
+		// when no injector pod was observed for this revision. With an
+		// injector present, the comparison above is authoritative; a proxy
+		// tag that differs from the template just means that pod is stale
+		// and awaiting restart (already surfaced by VersionAnalyzer, as
+		// IstioProxyRequiresRestart or, for a pod with no resolvable
+		// workload, IstioProxyVersionMismatch), not template drift.
+		if injectorVersions[rev] == nil {
+			for pv := range proxyVersions[rev] {
+				if templateTag != pv {
+					c.Report(collections.K8SCoreV1ConfigMaps.Name(), msg.NewIstioInjectionTemplateDrift(r, templateTag, pv))
+				}
+			}
+		}
+
+		return true
+	})
+}
+
+// sidecarInjectorRevision reports whether name is a sidecar injector
+// ConfigMap, and if so, the revision it configures.
+func sidecarInjectorRevision(name string) (revision string, ok bool) {
+	switch {
+	case name == sidecarInjectorConfigMapName:
+		return defaultRevision, true
+	case strings.HasPrefix(name, sidecarInjectorConfigMapName+"-"):
+		return strings.TrimPrefix(name, sidecarInjectorConfigMapName+"-"), true
+	default:
+		return "", false
+	}
+}
+
+// resolveTemplateTag parses the injection template's values.yaml and returns
+// the proxy image tag it resolves to.
+func resolveTemplateTag(values string) (tag string, ok bool) {
+	if values == "" {
+		return "", false
+	}
+
+	var v injectionValues
+	if err := yaml.Unmarshal([]byte(values), &v); err != nil {
+		return "", false
+	}
+
+	// The proxy image field is occasionally set to a fully qualified
+	// reference rather than a bare image name; in that case it carries its
+	// own tag, which takes precedence over global.tag.
+	if _, imageTag, _ := parseImageReference(v.Global.Proxy.Image); imageTag != "" {
+		return imageTag, true
+	}
+
+	if v.Global.Tag == "" {
+		return "", false
+	}
+
+	return v.Global.Tag, true
+}
+
+// collectProxyVersions scans pods for injected istio-proxy containers and
+// returns, for each revision, the set of distinct image tags observed.
+func collectProxyVersions(c analysis.Context) map[string]map[string]struct{} {
+	proxyVersions := make(map[string]map[string]struct{})
+
+	c.ForEach(collections.K8SCoreV1Pods.Name(), func(r *resource.Instance) bool {
+		pod := r.Message.(*v1.Pod)
+
+		if r.Metadata.Annotations["sidecar.istio.io/proxyImage"] != "" {
+			return true
+		}
+
+		rev := pod.Labels[IstioRevLabelName]
+		if rev == "" {
+			rev = defaultRevision
+		}
+
+		for _, container := range pod.Spec.Containers {
+			if container.Name != istioProxyName {
+				continue
+			}
+
+			_, tag, _ := getContainerImageReference(&container)
+			if tag == "" {
+				continue
+			}
+
+			if proxyVersions[rev] == nil {
+				proxyVersions[rev] = make(map[string]struct{})
+			}
+			proxyVersions[rev][tag] = struct{}{}
+		}
+
+		return true
+	})
+
+	return proxyVersions
+}
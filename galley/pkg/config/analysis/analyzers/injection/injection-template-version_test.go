@@ -0,0 +1,196 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injection
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/assert"
+
+	"istio.io/istio/galley/pkg/config/analysis/diag"
+	"istio.io/istio/galley/pkg/config/analysis/msg"
+	"istio.io/istio/pkg/config/resource"
+	"istio.io/istio/pkg/config/schema/collection"
+	"istio.io/istio/pkg/config/schema/collections"
+)
+
+// fakeContext is a minimal analysis.Context for exercising Analyze directly,
+// without the local-source test harness.
+type fakeContext struct {
+	resources map[collection.Name][]*resource.Instance
+	reports   []diag.Message
+}
+
+func (f *fakeContext) Report(_ collection.Name, m diag.Message) {
+	f.reports = append(f.reports, m)
+}
+
+func (f *fakeContext) Find(collection.Name, resource.FullName) *resource.Instance {
+	return nil
+}
+
+func (f *fakeContext) Exists(collection.Name, resource.FullName) bool {
+	return false
+}
+
+func (f *fakeContext) ForEach(col collection.Name, fn func(r *resource.Instance) bool) {
+	for _, r := range f.resources[col] {
+		if !fn(r) {
+			return
+		}
+	}
+}
+
+func (f *fakeContext) Canceled() bool {
+	return false
+}
+
+func TestResolveTemplateTag(t *testing.T) {
+	cases := []struct {
+		name    string
+		values  string
+		wantTag string
+		wantOk  bool
+	}{
+		{
+			name:    "tag from global.tag",
+			values:  "global:\n  tag: 1.20.0\n  hub: docker.io/istio\n  proxy:\n    image: proxyv2\n",
+			wantTag: "1.20.0",
+			wantOk:  true,
+		},
+		{
+			name:    "fully qualified proxy image wins over global.tag",
+			values:  "global:\n  tag: 1.19.0\n  proxy:\n    image: docker.io/istio/proxyv2:1.20.0\n",
+			wantTag: "1.20.0",
+			wantOk:  true,
+		},
+		{
+			name:    "proxy image with registry port and no tag falls back to global.tag",
+			values:  "global:\n  tag: 1.20.0\n  proxy:\n    image: registry:5000/istio/proxyv2\n",
+			wantTag: "1.20.0",
+			wantOk:  true,
+		},
+		{
+			name:   "no tag anywhere",
+			values: "global:\n  proxy:\n    image: proxyv2\n",
+			wantOk: false,
+		},
+		{
+			name:   "empty values",
+			values: "",
+			wantOk: false,
+		},
+		{
+			name:   "unparseable values",
+			values: "::not yaml::",
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tag, ok := resolveTemplateTag(tt.values)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.wantTag, tag)
+			}
+		})
+	}
+}
+
+func TestSidecarInjectorRevision(t *testing.T) {
+	cases := []struct {
+		name    string
+		cmName  string
+		wantRev string
+		wantOk  bool
+	}{
+		{name: "legacy name", cmName: "istio-sidecar-injector", wantRev: defaultRevision, wantOk: true},
+		{name: "revisioned name", cmName: "istio-sidecar-injector-canary", wantRev: "canary", wantOk: true},
+		{name: "unrelated configmap", cmName: "kube-root-ca.crt", wantOk: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rev, ok := sidecarInjectorRevision(tt.cmName)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.wantRev, rev)
+			}
+		})
+	}
+}
+
+func TestTemplateVersionAnalyzerAnalyze(t *testing.T) {
+	cmResource := &resource.Instance{
+		Message: &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: sidecarInjectorConfigMapName},
+			Data:       map[string]string{valuesConfigMapKey: "global:\n  tag: 1.20.0\n  proxy:\n    image: proxyv2\n"},
+		},
+	}
+
+	// Running injector matches the template; this proxy is simply stale and
+	// awaiting restart, which VersionAnalyzer reports separately.
+	staleProxyResource := &resource.Instance{
+		Message: &v1.Pod{
+			Spec: v1.PodSpec{Containers: []v1.Container{{Name: istioProxyName, Image: "istio/proxyv2:1.19.0"}}},
+		},
+	}
+	injectorResource := &resource.Instance{
+		Message: &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": istiodName}},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Name: istiodContainerName, Image: "istio/pilot:1.20.0"}}},
+		},
+	}
+
+	cases := []struct {
+		name      string
+		pods      []*resource.Instance
+		wantDrift bool
+	}{
+		{
+			name:      "template matches running injector, proxy merely stale",
+			pods:      []*resource.Instance{injectorResource, staleProxyResource},
+			wantDrift: false,
+		},
+		{
+			name:      "no injector observed, proxy differs from template",
+			pods:      []*resource.Instance{staleProxyResource},
+			wantDrift: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fakeContext{resources: map[collection.Name][]*resource.Instance{
+				collections.K8SCoreV1ConfigMaps.Name(): {cmResource},
+				collections.K8SCoreV1Pods.Name():       tt.pods,
+			}}
+
+			(&TemplateVersionAnalyzer{}).Analyze(ctx)
+
+			gotDrift := false
+			for _, m := range ctx.reports {
+				if m.Type == msg.IstioInjectionTemplateDrift {
+					gotDrift = true
+				}
+			}
+			assert.Equal(t, tt.wantDrift, gotDrift)
+		})
+	}
+}
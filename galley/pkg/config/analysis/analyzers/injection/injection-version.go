@@ -17,7 +17,10 @@ package injection
 import (
 	"strings"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"istio.io/istio/galley/pkg/config/analysis"
 	"istio.io/istio/galley/pkg/config/analysis/msg"
@@ -33,12 +36,66 @@ var _ analysis.Analyzer = &VersionAnalyzer{}
 
 const injectorName = "sidecar-injector-webhook"
 const sidecarInjectorName = "sidecarInjectorWebhook"
+const istiodName = "istiod"
+const istiodContainerName = "discovery"
 
-// podVersion is a helper struct for tracking a resource with its detected
-// proxy version.
-type podVersion struct {
-	Resource     *resource.Instance
-	ProxyVersion string
+// defaultRevision is the revision used for namespaces/pods/injectors that are
+// configured through the legacy, non-revisioned mechanism.
+const defaultRevision = "default"
+
+// sidecarInjectorWebhookSuffix is the suffix Istio gives to the
+// MutatingWebhookConfiguration entries it installs for sidecar injection.
+const sidecarInjectorWebhookSuffix = "sidecar-injector.istio.io"
+
+// IstioRevLabelName is the label used to pin a namespace or pod to a specific
+// Istio control plane revision.
+const IstioRevLabelName = "istio.io/rev"
+
+// IstioTagLabelName is the label Istio revision tags carry on the
+// MutatingWebhookConfiguration they install, aliasing a tag name to the
+// revision it currently points at.
+const IstioTagLabelName = "istio.io/tag"
+
+// imageVersions tracks the distinct tags and digests observed for a set of
+// same-purpose containers (e.g. all injector replicas for a revision).
+type imageVersions struct {
+	Tags    map[string]struct{}
+	Digests map[string]struct{}
+}
+
+func newImageVersions() *imageVersions {
+	return &imageVersions{Tags: make(map[string]struct{}), Digests: make(map[string]struct{})}
+}
+
+func (iv *imageVersions) add(tag, digest string) {
+	if tag != "" {
+		iv.Tags[tag] = struct{}{}
+	}
+	if digest != "" {
+		iv.Digests[digest] = struct{}{}
+	}
+}
+
+// onlyDigest returns the single digest in iv.Digests, if there is exactly
+// one; otherwise it returns false, since with more than one candidate we
+// can't tell which is authoritative.
+func (iv *imageVersions) onlyDigest() (string, bool) {
+	if len(iv.Digests) != 1 {
+		return "", false
+	}
+	for d := range iv.Digests {
+		return d, true
+	}
+	return "", false
+}
+
+// injectionWebhook is a parsed view of a single sidecar-injector mutating
+// webhook entry, used to determine which revision actually admits a given
+// namespace/pod pair.
+type injectionWebhook struct {
+	Revision          string
+	NamespaceSelector labels.Selector
+	ObjectSelector    labels.Selector
 }
 
 // Metadata implements Analyzer.
@@ -47,6 +104,11 @@ func (a *VersionAnalyzer) Metadata() analysis.Metadata {
 		Name:        "injection.VersionAnalyzer",
 		Description: "Checks the version of auto-injection configured with the running proxies on pods",
 		Inputs: collection.Names{
+			collections.K8SAdmissionregistrationK8SIoV1Mutatingwebhookconfigurations.Name(),
+			collections.K8SAppsV1Deployments.Name(),
+			collections.K8SAppsV1Daemonsets.Name(),
+			collections.K8SAppsV1Replicasets.Name(),
+			collections.K8SAppsV1Statefulsets.Name(),
 			collections.K8SCoreV1Namespaces.Name(),
 			collections.K8SCoreV1Pods.Name(),
 		},
@@ -55,94 +117,352 @@ func (a *VersionAnalyzer) Metadata() analysis.Metadata {
 
 // Analyze implements Analyzer.
 func (a *VersionAnalyzer) Analyze(c analysis.Context) {
-	injectedNamespaces := make(map[string]struct{})
+	webhooks := collectInjectionWebhooks(c)
+	injectorVersions, digestsByTag := collectImageInfo(c)
+	plan := newRestartPlan(c)
 
-	// Collect the list of namespaces that have istio injection enabled.
 	c.ForEach(collections.K8SCoreV1Namespaces.Name(), func(r *resource.Instance) bool {
-		if r.Metadata.Labels[InjectionLabelName] == InjectionLabelEnableValue {
-			injectedNamespaces[r.Metadata.FullName.String()] = struct{}{}
+		ns := r.Message.(*v1.Namespace)
+
+		// A nil label set would skip the namespace selector entirely, so an
+		// unlabeled namespace is matched against an empty set instead.
+		nsLabels := labels.Set(ns.Labels)
+		if nsLabels == nil {
+			nsLabels = labels.Set{}
 		}
+		matching := matchingWebhooks(webhooks, nsLabels, nil)
+		if len(matching) == 0 {
+			// Not every namespace is expected to be injected; only complain if
+			// this one was explicitly configured for injection.
+			if rev, labeled := namespaceRequestedRevision(ns.Labels); labeled {
+				c.Report(collections.K8SCoreV1Namespaces.Name(), msg.NewNamespaceInjectionWebhookMissingRevision(r, rev))
+			}
+			return true
+		}
+
+		c.ForEach(collections.K8SCoreV1Pods.Name(), func(pr *resource.Instance) bool {
+			pod := pr.Message.(*v1.Pod)
+			if pod.GetNamespace() != ns.GetName() {
+				return true
+			}
+
+			analyzePodVersion(c, pr, pod, matching, injectorVersions, digestsByTag, plan)
+
+			return true
+		})
 
 		return true
 	})
+}
 
-	injectorVersions := make(map[string]struct{})
-	var podVersions []podVersion
-	c.ForEach(collections.K8SCoreV1Pods.Name(), func(r *resource.Instance) bool {
-		pod := r.Message.(*v1.Pod)
+// analyzePodVersion determines the revision that admitted pod (if any) and,
+// when its proxy version is known, compares it against the injector version
+// for that same revision. Tag mismatches are routed through plan so that pods
+// sharing a workload surface a single restart message; digest mismatches are
+// reported per pod.
+func analyzePodVersion(c analysis.Context, r *resource.Instance, pod *v1.Pod, nsWebhooks []injectionWebhook,
+	injectorVersions map[string]*imageVersions, digestsByTag map[string]map[string]struct{}, plan *restartPlan) {
+	// Sidecar injector pods and pods with a custom sidecar image override are
+	// not subject to injector version comparison.
+	if pod.Labels["app"] == sidecarInjectorName || pod.Labels["app"] == istiodName {
+		return
+	}
+	if r.Metadata.Annotations["sidecar.istio.io/proxyImage"] != "" {
+		return
+	}
+
+	// Pods that were never meant to be injected (opted out via
+	// objectSelector, sidecar.istio.io/inject: "false", etc.) have no
+	// istio-proxy container and shouldn't be flagged just for not matching a
+	// webhook.
+	if !hasIstioProxyContainer(pod) {
+		return
+	}
+
+	podLabels := labels.Set(pod.Labels)
+	if podLabels == nil {
+		podLabels = labels.Set{}
+	}
+	matching := matchingWebhooks(nsWebhooks, nil, podLabels)
+	if len(matching) == 0 {
+		c.Report(collections.K8SCoreV1Pods.Name(), msg.NewPodMissingInjectionWebhook(r))
+		return
+	}
+
+	// Multiple webhooks intentionally targeting the same pod is not a
+	// supported configuration; use the first match, which mirrors webhook
+	// admission ordering closely enough for analysis purposes.
+	revision := matching[0].Revision
 
-		// Check if this is a sidecar injector pod - if it is, note its version.
-		if v := tryReturnSidecarInjectorVersion(pod); v != "" {
-			injectorVersions[v] = struct{}{}
+	injectorImages := injectorVersions[revision]
+	if injectorImages == nil {
+		return
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name != istioProxyName {
+			continue
 		}
 
-		if _, ok := injectedNamespaces[pod.GetNamespace()]; !ok {
-			return true
+		_, tag, digest := getContainerImageReference(&container)
+
+		// A pod with a concrete tag is compared against the injector's
+		// tag(s), the common case. Only flag it once it matches none of
+		// them, so a rolling injector upgrade (replicas briefly on two
+		// tags at once) doesn't generate a false mismatch against the
+		// replica that's already on the pod's version. Injector tags that
+		// are themselves "latest" carry no version information and are
+		// skipped, same as an untagged/"latest" pod below.
+		if tag != "" && tag != latestTag {
+			var firstOther string
+			matched, comparable := false, false
+			for iv := range injectorImages.Tags {
+				if iv == latestTag {
+					continue
+				}
+				comparable = true
+				if tag == iv {
+					matched = true
+					break
+				}
+				firstOther = iv
+			}
+			if comparable {
+				if !matched {
+					plan.recordMismatch(c, r, pod, tag, firstOther)
+				}
+				continue
+			}
 		}
 
-		// If the pod has been annotated with a custom sidecar, then ignore as
-		// it always overrides the injector logic.
-		if r.Metadata.Annotations["sidecar.istio.io/proxyImage"] != "" {
-			return true
+		// Otherwise the pod is effectively unversioned (no tag, or the
+		// floating "latest" tag), or the injector has no concrete tag to
+		// compare against, and the two can only be compared on digest.
+		if digest == "" {
+			continue
 		}
 
-		for _, container := range pod.Spec.Containers {
-			if container.Name != istioProxyName {
-				continue
+		expected, ok := resolveExpectedDigest(injectorImages, digestsByTag)
+		if ok && digest != expected {
+			c.Report(collections.K8SCoreV1Pods.Name(), msg.NewIstioProxyImageDigestMismatch(r, digest, expected))
+		}
+	}
+}
+
+// resolveExpectedDigest best-effort resolves the digest a pod pinned to
+// injectorImages' revision should be running. The registry can't be queried
+// to resolve a tag to a digest directly, so this corroborates using digests
+// already observed on other pods: the injector's own digest, if unambiguous,
+// or else the digest shared by every other pod running one of the injector's
+// tags.
+func resolveExpectedDigest(injectorImages *imageVersions, digestsByTag map[string]map[string]struct{}) (string, bool) {
+	if d, ok := injectorImages.onlyDigest(); ok {
+		return d, true
+	}
+
+	for tag := range injectorImages.Tags {
+		if ds, ok := digestsByTag[tag]; ok && len(ds) == 1 {
+			for d := range ds {
+				return d, true
 			}
-			// Attempt to parse out the version of the proxy.
-			v := getContainerNameVersion(&container)
-			// We can't check anything without a version; skip the pod.
-			if v == "" {
+		}
+	}
+
+	return "", false
+}
+
+// namespaceRequestedRevision returns the revision a namespace has been
+// explicitly labeled for, via either the legacy istio-injection=enabled label
+// or the istio.io/rev label, and whether any such label was present.
+func namespaceRequestedRevision(nsLabels map[string]string) (string, bool) {
+	if rev, ok := nsLabels[IstioRevLabelName]; ok {
+		return rev, true
+	}
+	if nsLabels[InjectionLabelName] == InjectionLabelEnableValue {
+		return defaultRevision, true
+	}
+	return "", false
+}
+
+// collectInjectionWebhooks parses every sidecar-injector MutatingWebhookConfiguration
+// into the revision and selectors it admits pods under.
+func collectInjectionWebhooks(c analysis.Context) []injectionWebhook {
+	var webhooks []injectionWebhook
+
+	c.ForEach(collections.K8SAdmissionregistrationK8SIoV1Mutatingwebhookconfigurations.Name(), func(r *resource.Instance) bool {
+		cfg := r.Message.(*admissionregistrationv1.MutatingWebhookConfiguration)
+
+		rev := cfg.GetLabels()[IstioRevLabelName]
+		if rev == "" {
+			rev = defaultRevision
+		}
+
+		for _, wh := range cfg.Webhooks {
+			if !strings.HasSuffix(wh.Name, sidecarInjectorWebhookSuffix) {
 				continue
 			}
-			// Note the pod/version to check later after we've collected all injector versions.
-			podVersions = append(podVersions, podVersion{
-				Resource:     r,
-				ProxyVersion: v})
 
+			nsSelector, err := metav1.LabelSelectorAsSelector(wh.NamespaceSelector)
+			if err != nil || wh.NamespaceSelector == nil {
+				nsSelector = labels.Everything()
+			}
+
+			objSelector, err := metav1.LabelSelectorAsSelector(wh.ObjectSelector)
+			if err != nil || wh.ObjectSelector == nil {
+				objSelector = labels.Everything()
+			}
+
+			webhooks = append(webhooks, injectionWebhook{
+				Revision:          rev,
+				NamespaceSelector: nsSelector,
+				ObjectSelector:    objSelector,
+			})
 		}
 
 		return true
 	})
 
-	for iv := range injectorVersions {
-		for _, pv := range podVersions {
-			if pv.ProxyVersion != iv {
-				c.Report(collections.K8SCoreV1Pods.Name(), msg.NewIstioProxyVersionMismatch(pv.Resource, pv.ProxyVersion, iv))
-			}
+	return webhooks
+}
+
+// matchingWebhooks returns the subset of webhooks whose namespace and object
+// selectors match the given namespace and pod labels. Either label set may be
+// nil, in which case that selector is not evaluated (used to first narrow by
+// namespace, then again by pod).
+func matchingWebhooks(webhooks []injectionWebhook, nsLabels, podLabels labels.Set) []injectionWebhook {
+	var matching []injectionWebhook
+	for _, wh := range webhooks {
+		if nsLabels != nil && !wh.NamespaceSelector.Matches(nsLabels) {
+			continue
+		}
+		if podLabels != nil && !wh.ObjectSelector.Matches(podLabels) {
+			continue
+		}
+		matching = append(matching, wh)
+	}
+	return matching
+}
+
+// hasIstioProxyContainer reports whether pod has an istio-proxy container,
+// i.e. whether it was actually injected.
+func hasIstioProxyContainer(pod *v1.Pod) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == istioProxyName {
+			return true
+		}
+	}
+	return false
+}
+
+// collectImageInfo scans every pod once to build two indexes: injectorVersions,
+// the set of distinct image tags and digests running per revision of the
+// sidecar injector, and digestsByTag, the set of digests observed (on the
+// injector or on injected proxies) under each tag. digestsByTag is the only
+// corroboration available for resolving a tag to a digest, since the
+// registry can't be queried directly.
+func collectImageInfo(c analysis.Context) (injectorVersions map[string]*imageVersions, digestsByTag map[string]map[string]struct{}) {
+	injectorVersions = make(map[string]*imageVersions)
+	digestsByTag = make(map[string]map[string]struct{})
+
+	record := func(tag, digest string) {
+		if tag == "" || digest == "" {
+			return
+		}
+		if digestsByTag[tag] == nil {
+			digestsByTag[tag] = make(map[string]struct{})
 		}
+		digestsByTag[tag][digest] = struct{}{}
 	}
+
+	c.ForEach(collections.K8SCoreV1Pods.Name(), func(r *resource.Instance) bool {
+		pod := r.Message.(*v1.Pod)
+
+		if rev, tag, digest := tryReturnSidecarInjectorVersion(pod); tag != "" || digest != "" {
+			if injectorVersions[rev] == nil {
+				injectorVersions[rev] = newImageVersions()
+			}
+			injectorVersions[rev].add(tag, digest)
+			record(tag, digest)
+		}
+
+		for _, container := range pod.Spec.Containers {
+			if container.Name != istioProxyName {
+				continue
+			}
+			_, tag, digest := getContainerImageReference(&container)
+			record(tag, digest)
+		}
+
+		return true
+	})
+
+	return injectorVersions, digestsByTag
 }
 
-// tryReturnSidecarInjectorVersion returns an empty string if the pod is not
-// the sidecar injector; otherwise the version of the injector image is
-// returned.
-func tryReturnSidecarInjectorVersion(p *v1.Pod) string {
-	if p.Labels["app"] != sidecarInjectorName {
-		return ""
+// tryReturnSidecarInjectorVersion returns an empty tag and digest if the pod
+// is not the sidecar injector; otherwise it returns the revision the injector
+// serves along with the tag and/or digest of the injector image.
+func tryReturnSidecarInjectorVersion(p *v1.Pod) (revision, tag, digest string) {
+	var wantContainer string
+
+	switch p.Labels["app"] {
+	case sidecarInjectorName:
+		revision = defaultRevision
+		wantContainer = injectorName
+	case istiodName:
+		revision = p.Labels[IstioRevLabelName]
+		if revision == "" {
+			revision = defaultRevision
+		}
+		// istiod serves injection from the same process as discovery; there
+		// is no separate "sidecar-injector-webhook" container to look for.
+		wantContainer = istiodContainerName
+	default:
+		return "", "", ""
 	}
 
 	for _, c := range p.Spec.Containers {
-		if c.Name != injectorName {
+		if c.Name != wantContainer {
 			continue
 		}
 
-		v := getContainerNameVersion(&c)
-		return v
+		_, tag, digest := getContainerImageReference(&c)
+		return revision, tag, digest
 	}
 
-	return ""
+	return "", "", ""
+}
+
+// latestTag is the floating tag that carries no version information of its
+// own; pods running it can only be compared by digest.
+const latestTag = "latest"
+
+// getContainerImageReference parses a container's image into its repository,
+// tag and digest components. See parseImageReference for the grammar
+// supported.
+func getContainerImageReference(c *v1.Container) (repository, tag, digest string) {
+	return parseImageReference(c.Image)
 }
 
-// getContainerNameVersion parses the name and version from a container image.
-// If the version is not specified or can't be found, version is the empty
-// string.
-func getContainerNameVersion(c *v1.Container) (version string) {
-	parts := strings.Split(c.Image, ":")
-	if len(parts) != 2 {
-		return ""
+// parseImageReference parses an OCI image reference into its repository, tag
+// and digest components, handling registries with a port
+// (registry:5000/repo:tag), digest pins (repo@sha256:...) and tag+digest
+// combinations. Any component not present in the reference is returned as an
+// empty string.
+func parseImageReference(image string) (repository, tag, digest string) {
+	if at := strings.LastIndex(image, "@"); at >= 0 {
+		digest = image[at+1:]
+		image = image[:at]
 	}
-	version = parts[1]
-	return
+
+	// A colon belongs to the tag only if it appears after the last slash;
+	// otherwise it's part of a registry host:port.
+	if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		repository = image[:colon]
+		tag = image[colon+1:]
+	} else {
+		repository = image
+	}
+
+	return repository, tag, digest
 }
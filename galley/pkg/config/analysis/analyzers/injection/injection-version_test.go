@@ -0,0 +1,203 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injection
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustSelector(t *testing.T, ls *metav1.LabelSelector) labels.Selector {
+	t.Helper()
+	s, err := metav1.LabelSelectorAsSelector(ls)
+	if err != nil {
+		t.Fatalf("invalid label selector: %v", err)
+	}
+	return s
+}
+
+func TestMatchingWebhooks(t *testing.T) {
+	cases := []struct {
+		name      string
+		webhooks  []injectionWebhook
+		nsLabels  labels.Set
+		podLabels labels.Set
+		wantRevs  []string
+	}{
+		{
+			name: "namespace matches single revision",
+			webhooks: []injectionWebhook{
+				{Revision: "default", NamespaceSelector: mustSelector(t, &metav1.LabelSelector{
+					MatchLabels: map[string]string{"istio-injection": "enabled"},
+				}), ObjectSelector: labels.Everything()},
+				{Revision: "canary", NamespaceSelector: mustSelector(t, &metav1.LabelSelector{
+					MatchLabels: map[string]string{IstioRevLabelName: "canary"},
+				}), ObjectSelector: labels.Everything()},
+			},
+			nsLabels: labels.Set{"istio-injection": "enabled"},
+			wantRevs: []string{"default"},
+		},
+		{
+			name: "namespace matches no revision",
+			webhooks: []injectionWebhook{
+				{Revision: "canary", NamespaceSelector: mustSelector(t, &metav1.LabelSelector{
+					MatchLabels: map[string]string{IstioRevLabelName: "canary"},
+				}), ObjectSelector: labels.Everything()},
+			},
+			nsLabels: labels.Set{"istio-injection": "enabled"},
+			wantRevs: nil,
+		},
+		{
+			name: "pod excluded by objectSelector",
+			webhooks: []injectionWebhook{
+				{Revision: "default", NamespaceSelector: labels.Everything(), ObjectSelector: mustSelector(t, &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "sidecar.istio.io/inject", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"false"}},
+					},
+				})},
+			},
+			podLabels: labels.Set{"sidecar.istio.io/inject": "false"},
+			wantRevs:  nil,
+		},
+		{
+			name: "pod matches objectSelector",
+			webhooks: []injectionWebhook{
+				{Revision: "default", NamespaceSelector: labels.Everything(), ObjectSelector: mustSelector(t, &metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "sidecar.istio.io/inject", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"false"}},
+					},
+				})},
+			},
+			podLabels: labels.Set{"app": "foo"},
+			wantRevs:  []string{"default"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var nsLabels, podLabels labels.Set
+			if tt.nsLabels != nil {
+				nsLabels = tt.nsLabels
+			}
+			if tt.podLabels != nil {
+				podLabels = tt.podLabels
+			}
+
+			got := matchingWebhooks(tt.webhooks, nsLabels, podLabels)
+
+			var gotRevs []string
+			for _, wh := range got {
+				gotRevs = append(gotRevs, wh.Revision)
+			}
+			assert.Equal(t, tt.wantRevs, gotRevs)
+		})
+	}
+}
+
+func TestNamespaceRequestedRevision(t *testing.T) {
+	cases := []struct {
+		name    string
+		labels  map[string]string
+		wantRev string
+		wantOk  bool
+	}{
+		{
+			name:    "legacy label",
+			labels:  map[string]string{InjectionLabelName: InjectionLabelEnableValue},
+			wantRev: defaultRevision,
+			wantOk:  true,
+		},
+		{
+			name:    "revision label",
+			labels:  map[string]string{IstioRevLabelName: "canary"},
+			wantRev: "canary",
+			wantOk:  true,
+		},
+		{
+			name:   "no label",
+			labels: map[string]string{"foo": "bar"},
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rev, ok := namespaceRequestedRevision(tt.labels)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.wantRev, rev)
+			}
+		})
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	cases := []struct {
+		name       string
+		image      string
+		wantRepo   string
+		wantTag    string
+		wantDigest string
+	}{
+		{
+			name:     "name and tag",
+			image:    "istio/proxyv2:1.20.0",
+			wantRepo: "istio/proxyv2",
+			wantTag:  "1.20.0",
+		},
+		{
+			name:     "registry with port and tag",
+			image:    "registry:5000/istio/proxyv2:1.20.0",
+			wantRepo: "registry:5000/istio/proxyv2",
+			wantTag:  "1.20.0",
+		},
+		{
+			name:     "registry with port and no tag",
+			image:    "registry:5000/istio/proxyv2",
+			wantRepo: "registry:5000/istio/proxyv2",
+		},
+		{
+			name:       "digest pin with no tag",
+			image:      "istio/proxyv2@sha256:abcd1234",
+			wantRepo:   "istio/proxyv2",
+			wantDigest: "sha256:abcd1234",
+		},
+		{
+			name:       "tag and digest combined",
+			image:      "istio/proxyv2:1.20.0@sha256:abcd1234",
+			wantRepo:   "istio/proxyv2",
+			wantTag:    "1.20.0",
+			wantDigest: "sha256:abcd1234",
+		},
+		{
+			name:     "bare name, no tag or registry",
+			image:    "proxyv2",
+			wantRepo: "proxyv2",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, tag, digest := parseImageReference(tt.image)
+			assert.Equal(t, tt.wantRepo, repo)
+			assert.Equal(t, tt.wantTag, tag)
+			assert.Equal(t, tt.wantDigest, digest)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// GENERATED FILE -- DO NOT EDIT
+//
+
+package msg
+
+import (
+	"istio.io/istio/galley/pkg/config/analysis/diag"
+	"istio.io/istio/pkg/config/resource"
+)
+
+var (
+	// IstioInjectionTemplateDrift defines a diag.MessageType for message "IstioInjectionTemplateDrift".
+	IstioInjectionTemplateDrift = diag.NewMessageType(diag.Warning, "IST0151", "The injection template resolves to proxy image tag %q, but %q is running; the injection configuration may be partially applied.")
+
+	// PodMissingInjectionWebhook defines a diag.MessageType for message "PodMissingInjectionWebhook".
+	PodMissingInjectionWebhook = diag.NewMessageType(diag.Warning, "IST0152", "This pod is in a namespace configured for injection, but does not match any active sidecar injection webhook.")
+
+	// NamespaceInjectionWebhookMissingRevision defines a diag.MessageType for message "NamespaceInjectionWebhookMissingRevision".
+	NamespaceInjectionWebhookMissingRevision = diag.NewMessageType(diag.Warning, "IST0153", "This namespace is labeled for revision %q, but no sidecar injector webhook for that revision was found.")
+
+	// IstioProxyImageDigestMismatch defines a diag.MessageType for message "IstioProxyImageDigestMismatch".
+	IstioProxyImageDigestMismatch = diag.NewMessageType(diag.Warning, "IST0154", "This pod's proxy image digest %q does not match the expected digest %q resolved from the sidecar injector.")
+
+	// IstioProxyRequiresRestart defines a diag.MessageType for message "IstioProxyRequiresRestart".
+	IstioProxyRequiresRestart = diag.NewMessageType(diag.Warning, "IST0155", "This workload's proxies do not match the current sidecar injector version; run `%s` to update them.")
+)
+
+// NewIstioInjectionTemplateDrift returns a new diag.Message based on IstioInjectionTemplateDrift.
+func NewIstioInjectionTemplateDrift(r *resource.Instance, templateTag string, runningTag string) diag.Message {
+	return diag.NewMessage(
+		IstioInjectionTemplateDrift,
+		r,
+		templateTag,
+		runningTag,
+	)
+}
+
+// NewPodMissingInjectionWebhook returns a new diag.Message based on PodMissingInjectionWebhook.
+func NewPodMissingInjectionWebhook(r *resource.Instance) diag.Message {
+	return diag.NewMessage(
+		PodMissingInjectionWebhook,
+		r,
+	)
+}
+
+// NewNamespaceInjectionWebhookMissingRevision returns a new diag.Message based on NamespaceInjectionWebhookMissingRevision.
+func NewNamespaceInjectionWebhookMissingRevision(r *resource.Instance, revision string) diag.Message {
+	return diag.NewMessage(
+		NamespaceInjectionWebhookMissingRevision,
+		r,
+		revision,
+	)
+}
+
+// NewIstioProxyImageDigestMismatch returns a new diag.Message based on IstioProxyImageDigestMismatch.
+func NewIstioProxyImageDigestMismatch(r *resource.Instance, podDigest string, expectedDigest string) diag.Message {
+	return diag.NewMessage(
+		IstioProxyImageDigestMismatch,
+		r,
+		podDigest,
+		expectedDigest,
+	)
+}
+
+// NewIstioProxyRequiresRestart returns a new diag.Message based on IstioProxyRequiresRestart.
+func NewIstioProxyRequiresRestart(r *resource.Instance, command string) diag.Message {
+	return diag.NewMessage(
+		IstioProxyRequiresRestart,
+		r,
+		command,
+	)
+}